@@ -0,0 +1,171 @@
+package nego
+
+import (
+	"fmt"
+	"errors"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// KEMSuite is an alternative to the classical crypto.Suite-with-Hiding
+// path, for ciphersuites whose ephemeral contribution to a negotiation
+// header is a key-encapsulation ciphertext rather than a
+// Diffie-Hellman point. Implementations must produce ciphertexts that
+// are indistinguishable from random bytes, either natively or via a
+// rejection-sampling/Elligator-like wrapper of their own, so that the
+// layout algorithm can treat a KEM ciphertext exactly like a hidden DH
+// point when reserving header positions.
+type KEMSuite interface {
+	String() string
+
+	// CiphertextLen returns the fixed length, in bytes, of the
+	// ciphertexts Encapsulate produces for this suite.
+	CiphertextLen() int
+
+	// Encapsulate generates a fresh ciphertext/shared-secret pair for
+	// the recipient holding pub.
+	Encapsulate(pub []byte, rand cipher.Stream) (ct, ss []byte, err error)
+
+	// Decapsulate recovers the shared secret embedded in ct, given
+	// the recipient's private key.
+	Decapsulate(priv, ct []byte) (ss []byte, err error)
+}
+
+// initKEM is the KEM-path counterpart of suiteInfo.init: it determines
+// the alternative ciphertext positions for a KEM ciphersuite using the
+// same tag/level schedule as the DH path, so classical and
+// post-quantum recipients can coexist in a single header without
+// coordination.
+func (si *suiteInfo) initKEM(kem KEMSuite, nlevels, elen int, layoutSeed []byte) error {
+	si.kem = kem
+	si.plen = kem.CiphertextLen()
+
+	// layoutSeed, when set, is mixed into the seed so that two sides
+	// sharing it agree on an alternate deterministic schedule.
+	str := append([]byte(fmt.Sprintf("NegoCipherSuite:%s", kem.String())), layoutSeed...)
+	rand := localHashStream(str)
+
+	return si.schedule(nlevels, elen, rand)
+}
+
+// localHashStream derives a deterministic pseudo-random stream from
+// seed, for use by ciphersuites (like KEMSuite) that have no
+// crypto.Suite of their own to drive crypto.HashStream.
+func localHashStream(seed []byte) cipher.Stream {
+	key := sha256.Sum256(seed)
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		panic(err) // aes.NewCipher never fails for a 16-byte key
+	}
+	var iv [aes.BlockSize]byte
+	return cipher.NewCTR(block, iv[:])
+}
+
+// sealKEM is the KEM-path counterpart of seal: it derives the entry's
+// AEAD key directly from the KEM shared secret, instead of from a DH
+// computation, then seals the entrypoint slot the same way.
+func sealKEM(buf []byte, at int, kem KEMSuite, ss []byte, s payseg) error {
+	key := kdf("NegoEntryKey:"+kem.String(), ss)
+
+	var posb [4]byte
+	binary.BigEndian.PutUint32(posb[:], uint32(at))
+	nonce := kdf("NegoEntryNonce:"+kem.String(), posb[:])
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	plain := make([]byte, entryPlainLen)
+	copy(plain[0:entryKeyLen], s.key)
+	binary.BigEndian.PutUint32(plain[entryKeyLen:entryKeyLen+entryOffLen], uint32(s.start))
+	binary.BigEndian.PutUint32(plain[entryKeyLen+entryOffLen:], uint32(s.end))
+
+	ct := gcm.Seal(nil, nonce[:gcm.NonceSize()], plain, nil)
+	copy(buf[at:], ct)
+	return nil
+}
+
+// ReadKEM is the KEM-path counterpart of Reader.Read: it searches blob
+// for an entrypoint usable by the holder of priv, a KEM private key,
+// trying every candidate level for kem in turn. layoutSeed must match
+// the Writer.LayoutSeed used to produce blob, if any.
+func (r *Reader) ReadKEM(blob []byte, kem KEMSuite, priv []byte,
+			entryLen int, kemLevel map[KEMSuite]int,
+			layoutSeed []byte) ([]byte, error) {
+
+	if entryLen < minEntryLen {
+		return nil, errors.New("entryLen too small to hold a sealed entrypoint slot")
+	}
+	nlevels, ok := kemLevel[kem]
+	if !ok {
+		return nil, errors.New("KEM ciphersuite not in kemLevel: "+kem.String())
+	}
+
+	si := suiteInfo{}
+	if err := si.initKEM(kem, nlevels, entryLen, layoutSeed); err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var start, end int
+	found := false
+	for i := 0; i < nlevels; i++ {
+		k, s, e, ok := tryEntryKEM(blob, si.pos[i], si.plen, kem, priv)
+		if ok && !found {
+			found, key, start, end = true, k, s, e
+		}
+	}
+	if !found {
+		return nil, errors.New("no entrypoint for this recipient in blob")
+	}
+	if start < 0 || end > len(blob) || start > end {
+		return nil, errors.New("entrypoint payload range out of bounds")
+	}
+
+	return decryptSegment(blob[start:end], key)
+}
+
+// tryEntryKEM is the KEM-path counterpart of tryEntry.
+func tryEntryKEM(blob []byte, lo, plen int, kem KEMSuite, priv []byte) (key []byte, start, end int, ok bool) {
+	at := lo + plen
+	ctlen := entryPlainLen + entryTagLen
+	if at+ctlen > len(blob) {
+		return nil, 0, 0, false
+	}
+
+	ss, err := kem.Decapsulate(priv, blob[lo:lo+plen])
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	ekey := kdf("NegoEntryKey:"+kem.String(), ss)
+
+	var posb [4]byte
+	binary.BigEndian.PutUint32(posb[:], uint32(at))
+	nonce := kdf("NegoEntryNonce:"+kem.String(), posb[:])
+
+	block, err := aes.NewCipher(ekey)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	plain, err := gcm.Open(nil, nonce[:gcm.NonceSize()], blob[at:at+ctlen], nil)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+
+	key = make([]byte, entryKeyLen)
+	copy(key, plain[0:entryKeyLen])
+	start = int(binary.BigEndian.Uint32(plain[entryKeyLen : entryKeyLen+entryOffLen]))
+	end = int(binary.BigEndian.Uint32(plain[entryKeyLen+entryOffLen:]))
+	return key, start, end, true
+}
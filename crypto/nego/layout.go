@@ -0,0 +1,73 @@
+package nego
+
+import "fmt"
+
+// suiteID identifies a ciphersuite contributing a position to a
+// negotiation header layout, whether it's a classical crypto.Suite
+// using the Diffie-Hellman/Hiding path or a KEMSuite using the
+// key-encapsulation path.
+type suiteID interface {
+	String() string
+}
+
+// A node represents one byte-range reservation within a negotiation
+// header, claimed by a particular ciphersuite at a particular
+// alternative-position level.
+type node struct {
+	ste   suiteID // ciphersuite that owns this reservation
+	level int          // alternative-position level within the suite
+	lo    int           // low byte offset of the reserved range (inclusive)
+	hi    int           // high byte offset of the reserved range (exclusive)
+	tag   uint32        // pseudo-random tag used to pick this position
+}
+
+func (n *node) init(ste suiteID, level, lo, hi int, tag uint32) {
+	n.ste = ste
+	n.level = level
+	n.lo = lo
+	n.hi = hi
+	n.tag = tag
+}
+
+// layout tracks the set of byte-ranges within a negotiation header that
+// have been reserved so far, so that alternative positions for different
+// ciphersuites can be detected and resolved as they collide.
+type layout struct {
+	nodes []*node
+}
+
+// init (re)initializes a layout to the empty state.
+func (l *layout) init() {
+	l.nodes = nil
+}
+
+// insert attempts to reserve n's byte range.
+// It returns false, without modifying the layout,
+// if n's range overlaps a range some other node already reserved.
+func (l *layout) insert(n *node) bool {
+	for _, o := range l.nodes {
+		if n.lo < o.hi && o.lo < n.hi {
+			return false
+		}
+	}
+	l.nodes = append(l.nodes, n)
+	return true
+}
+
+// remove releases a previously-reserved node, freeing its byte range
+// for some other ciphersuite to claim.
+func (l *layout) remove(n *node) {
+	for i, o := range l.nodes {
+		if o == n {
+			l.nodes = append(l.nodes[:i], l.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// dump prints the current layout, for debugging.
+func (l *layout) dump() {
+	for _, n := range l.nodes {
+		fmt.Printf("  %s:%d %d-%d\n", n.ste.String(), n.level, n.lo, n.hi)
+	}
+}
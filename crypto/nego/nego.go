@@ -6,16 +6,52 @@ import (
 	"fmt"
 	"sort"
 	"errors"
+	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"dissent/crypto"
 )
 
+// Fixed layout of an entrypoint's sealed slot, before AEAD sealing:
+// a 16-byte symmetric payload key, followed by a 4-byte payload start
+// offset and a 4-byte payload end offset, both relative to the blob
+// returned by Write.
+const entryKeyLen = 16
+const entryOffLen = 4
+const entryPlainLen = entryKeyLen + 2*entryOffLen
+
+// Length of the AEAD authentication tag added by entry sealing.
+// AES-GCM's standard tag size.
+const entryTagLen = 16
+
+// Minimum entryLen Writer.Init will accept: enough to hold the sealed
+// entrypoint slot (entryPlainLen of plaintext plus its AEAD tag).
+const minEntryLen = entryPlainLen + entryTagLen
+
 
 type Entry struct {
 	Suite crypto.Suite	// Ciphersuite this public key is drawn from
 	PubKey crypto.Point	// Public key of this entrypoint's owner
-	Data []byte		// Entrypoint data decryptable by owner
+
+	// Alternatively to Suite/PubKey, an entrypoint may be owned by a
+	// recipient of a post-quantum KEM ciphersuite: set KEM and KEMPub
+	// instead, and leave Suite/PubKey nil.
+	KEM KEMSuite		// KEM ciphersuite this public key is drawn from
+	KEMPub []byte		// Recipient's KEM public key
+}
+
+// entryID reports which ciphersuite (classical or KEM) an entry uses.
+func entryID(e *Entry) (suiteID, error) {
+	switch {
+	case e.Suite != nil:
+		return e.Suite, nil
+	case e.KEM != nil:
+		return e.KEM, nil
+	default:
+		return nil, errors.New("entrypoint has neither a DH ciphersuite nor a KEM ciphersuite set")
+	}
 }
 
 
@@ -36,6 +72,47 @@ type Entry struct {
 //
 type Writer struct {
 	layout
+
+	lay Layout
+
+	// LayoutSeed, if set before calling Init, is mixed into the
+	// position-schedule randomness of every ciphersuite in the
+	// header, producing an alternate but still deterministic layout.
+	// This is for generating reproducible negotiation-specific test
+	// vectors and for fuzzing: leave it nil for production use, where
+	// the schedule should depend only on the ciphersuite itself.
+	LayoutSeed []byte
+}
+
+// Layout holds the precomputed part of a negotiation header: the
+// position schedule for every ciphersuite in use, and which
+// entrypoint uses which ciphersuite. Computing a Layout is the
+// expensive part of producing a header; WriteWith amortizes that cost
+// across many independent headers sharing the same suite set and
+// entrypoints, which is exactly Init's doc comment promises.
+//
+// Obtain a Layout via Writer.Layout after calling Init.
+type Layout struct {
+	stes   []suiteInfo          // layout info, one per ciphersuite in use
+	suite  map[suiteID]*suiteInfo // the above, indexed by ciphersuite
+	entry  map[*Entry]*suiteInfo       // which suiteInfo each entrypoint uses
+	hdrlen int                         // total length of the header region
+	padding Padding                    // optional blob-length padding scheme
+}
+
+// Layout returns the Layout computed by the preceding call to Init,
+// for reuse across multiple independent negotiation headers via
+// WriteWith.
+func (w *Writer) Layout() *Layout {
+	return &w.lay
+}
+
+// SetPadding installs a padding scheme that Write applies to the
+// length of every blob it produces, to reduce how much a blob's size
+// on the wire reveals about its true contents. With no padding scheme
+// set, the default, Write emits blobs at their exact true length.
+func (w *Writer) SetPadding(p Padding) {
+	w.lay.padding = p
 }
 
 
@@ -59,31 +136,71 @@ func (s *suiteKey) fresh(suite crypto.Suite) {
 */
 
 type suiteInfo struct {
-	ste crypto.Suite		// ciphersuite
+	ste crypto.Suite		// classical DH ciphersuite, or nil if kem is set
+	kem KEMSuite			// KEM ciphersuite, or nil if ste is set
 	tag []uint32			// per-position pseudorandom tag
-	pos []int			// alternative point positions
-	plen int			// length of each point in bytes
+	pos []int			// alternative point/ciphertext positions
+	plen int			// length of each point/ciphertext in bytes
+	elen int			// length of the entrypoint slot following the point
 	max int				// limit of highest point field
 
+	// entrypoints using this ciphersuite, in Init's entrypoints order;
+	// each gets its own position, level lev+i for entries[i], so that
+	// entrypoints sharing a ciphersuite never collide.
+	entries []*Entry
+
 	// layout info
 	nodes []*node			// layout node for reserved positions
-	lev int				// layout-chosen level for this suite
+	lev int				// lowest layout-chosen level for this suite
+	top int				// highest layout-chosen level for this suite
+}
+
+// id returns whichever of ste or kem identifies this suiteInfo.
+func (si *suiteInfo) id() suiteID {
+	if si.ste != nil {
+		return si.ste
+	}
+	return si.kem
 }
 
 // Determine all the alternative DH point positions for a ciphersuite.
-func (si *suiteInfo) init(ste crypto.Suite, nlevels int) {
+// Each position reserves plen bytes for the ciphersuite's uniform DH
+// point representation, immediately followed by elen bytes for the
+// sealed entrypoint slot of whichever entry uses this ciphersuite.
+func (si *suiteInfo) init(ste crypto.Suite, nlevels, elen int, layoutSeed []byte) error {
 	si.ste = ste
-	si.tag = make([]uint32, nlevels)
-	si.pos = make([]int, nlevels)
-	si.plen = ste.Point().(crypto.Hiding).HideLen()	// XXX
+	hiding, ok := ste.Point().(crypto.Hiding)
+	if !ok {
+		return errors.New("ciphersuite's Point type does not support Hiding: "+ste.String())
+	}
+	si.plen = hiding.HideLen()
 
-	// Create a pseudo-random stream from which to pick positions
+	// Create a pseudo-random stream from which to pick positions.
+	// layoutSeed, when set, is mixed in via HashStream's key argument
+	// to produce an alternate but still deterministic schedule.
 	str := fmt.Sprintf("NegoCipherSuite:%s", ste.String())
-	rand := crypto.HashStream(ste, []byte(str), nil)
+	rand := crypto.HashStream(ste, []byte(str), layoutSeed)
+
+	return si.schedule(nlevels, elen, rand)
+}
+
+// schedule fills in the alternative position table given si.plen
+// already set and a pseudo-random stream to draw position choices
+// from; it's shared by the classical DH path (init) and the KEM path
+// (initKEM). nlevels must be at least 1: a ciphersuite with no levels
+// at all has nowhere to put its point, and indexing si.pos[nlevels-1]
+// below would otherwise panic on caller-supplied input.
+func (si *suiteInfo) schedule(nlevels, elen int, rand cipher.Stream) error {
+	if nlevels < 1 {
+		return errors.New("ciphersuite level must be at least 1: "+si.id().String())
+	}
+	si.tag = make([]uint32, nlevels)
+	si.pos = make([]int, nlevels)
+	si.elen = elen
+	stride := si.plen + si.elen
 
 	// Alternative 0 is always at position 0, so start with level 1.
 	levofs := 0			// starting offset for current level
-	fmt.Printf("Suite %s positions:\n", ste.String())
 	for i := 0; i < nlevels; i++ {
 
 		// Pick a random position within this level
@@ -93,27 +210,24 @@ func (si *suiteInfo) init(ste crypto.Suite, nlevels int) {
 		levmask := levlen - 1	// alternative index mask
 		si.tag[i] = binary.BigEndian.Uint32(buf[:])
 		levidx := int(si.tag[i]) & levmask
-		si.pos[i] = levofs + levidx * si.plen
+		si.pos[i] = levofs + levidx * stride
 
-		fmt.Printf("%d: idx %d/%d pos %d\n",
-				i, levidx, levlen, si.pos[i])
-
-		levofs += levlen * si.plen	// next level table offset
+		levofs += levlen * stride	// next level table offset
 	}
 
-	// Limit of highest point field
-	si.max = si.pos[nlevels-1] + si.plen
+	// Limit of highest point+entrypoint field
+	si.max = si.pos[nlevels-1] + si.plen + si.elen
 
 	si.nodes = make([]*node, nlevels)
+	return nil
 }
 
 // Try to reserve a space for level i of this ciphersuite in the layout.
 func (si *suiteInfo) layout(w *Writer, i int) bool {
 	var n node
 	lo := si.pos[i]			// compute byte extent
-	hi := lo + si.plen
-	n.init(si.ste, i, lo, hi, si.tag[i])	// create suitable node
-	fmt.Printf("try insert %s:%d at %d-%d\n", si.ste.String(), i, lo, hi)
+	hi := lo + si.plen + si.elen
+	n.init(si.id(), i, lo, hi, si.tag[i])	// create suitable node
 	if !w.layout.insert(&n) {
 		return false
 	}
@@ -141,12 +255,19 @@ func (s *suites) Swap(i,j int) {
 // containing a specified set of entrypoints,
 // whose owners' public keys are drawn from a given set of ciphersuites.
 //
-// The caller must provide a map 'suiteLevel' with one key per ciphersuite,
-// whose value is the maximum "level" in the header 
-// at which the ciphersuite's ephemeral Diffie-Hellman Point may be encoded.
-// This maximum level must be standardized for each ciphersuite,
+// The caller must provide a map 'suiteLevel' with one key per classical
+// ciphersuite, whose value is the maximum "level" in the header
+// at which the ciphersuite's ephemeral Diffie-Hellman Point may be encoded,
+// and/or a map 'kemLevel' with one key per KEM ciphersuite, whose value is
+// likewise the maximum level at which that suite's encapsulation
+// ciphertext may be encoded. Either map may be nil if no entrypoints use
+// that path. These maximum levels must be standardized for each ciphersuite,
 // and should be log2(maxsuites), where maxsuites is the maximum number
 // of unique ciphersuites that are likely to exist when this suite is defined.
+// A ciphersuite's level must also be high enough to give every entrypoint
+// that uses it, in a given call to Init, its own distinct position:
+// Init returns an error if the level is too low for the number of
+// entrypoints sharing that ciphersuite.
 //
 // All entrypoints will carry a payload entryLen bytes long,
 // although the content of these payloads need not be specified yet.
@@ -158,35 +279,59 @@ func (s *suites) Swap(i,j int) {
 // multiple independent negotiation headers with varying entrypoint data
 // may be produced more efficiently via Write().
 //
-func (w *Writer) Init(suiteLevel map[crypto.Suite]int,
+func (w *Writer) Init(suiteLevel map[crypto.Suite]int, kemLevel map[KEMSuite]int,
 			entryLen int, entrypoints []Entry,
 			rand cipher.Stream) (int,error) {
 
-	w.layout.init()
-
-	// Determine the set of ciphersuites in use.
-/*
-	suites := make(map[crypto.Suite]struct{})
-	for i := range(entrypoints) {
-		entry := entrypoints[i]
-		if _,ok := suites[suite]; !ok {
-			// First time we've seen this ciphersuite.
-			suites[suite] = struct{}{}
-		}
+	if entryLen < minEntryLen {
+		return 0,errors.New("entryLen too small to hold a sealed entrypoint slot")
 	}
-*/
 
-	// Compute the alternative DH point positions for each ciphersuite,
-	// and the maximum byte offset for each.
+	w.layout.init()
+
+	// Compute the alternative position schedule for each classical DH
+	// ciphersuite and each KEM ciphersuite, and the maximum byte offset
+	// for each.
 	stes := suites{}
-	stes.s = make([]suiteInfo, 0, len(suiteLevel))
+	stes.s = make([]suiteInfo, 0, len(suiteLevel)+len(kemLevel))
 	for suite,nlevels := range suiteLevel {
 		si := suiteInfo{}
-		si.init(suite,nlevels)
+		if err := si.init(suite,nlevels,entryLen,w.LayoutSeed); err != nil {
+			return 0,err
+		}
+		stes.s = append(stes.s, si)
+	}
+	for kem,nlevels := range kemLevel {
+		si := suiteInfo{}
+		if err := si.initKEM(kem,nlevels,entryLen,w.LayoutSeed); err != nil {
+			return 0,err
+		}
 		stes.s = append(stes.s, si)
 	}
 	nsuites := len(stes.s)
 
+	// Assign each entrypoint to the suiteInfo for its ciphersuite,
+	// before laying out positions, so that every suiteInfo knows how
+	// many distinct positions it needs to reserve: one per entrypoint
+	// using it, since entrypoints sharing a ciphersuite must never
+	// share a position.
+	byID := make(map[suiteID]int, nsuites)
+	for i := range stes.s {
+		byID[stes.s[i].id()] = i
+	}
+	for i := range entrypoints {
+		e := &entrypoints[i]
+		id, err := entryID(e)
+		if err != nil {
+			return 0,err
+		}
+		idx, ok := byID[id]
+		if !ok {
+			return 0,errors.New("entrypoint uses a ciphersuite not in suiteLevel/kemLevel: "+id.String())
+		}
+		stes.s[idx].entries = append(stes.s[idx].entries, e)
+	}
+
 	// Sort the ciphersuites in order of max position,
 	// to give ciphersuites with most restrictive positioning
 	// "first dibs" on the lowest positions.
@@ -196,14 +341,13 @@ func (w *Writer) Init(suiteLevel map[crypto.Suite]int,
 	hdrlen := 0
 	for i := 0; i < nsuites; i++ {
 		s := &stes.s[i]
-		fmt.Printf("max %d: %s\n", s.max, s.ste.String())
 
 		// Find the lowest level that isn't shadowed by another suite,
 		// ensuring that our point won't be corrupted when the points
 		// for later (higher) suites get computed and filled in.
 		j := len(s.pos)-1
 		if !s.layout(w,j) {
-			return 0,errors.New("failed to find viable position for ciphersuite "+s.ste.String())
+			return 0,errors.New("failed to find viable position for ciphersuite "+s.id().String())
 		}
 		for ; j > 0; j-- {
 			if !s.layout(w,j-1) {	// is position j-1 free too?
@@ -211,34 +355,255 @@ func (w *Writer) Init(suiteLevel map[crypto.Suite]int,
 			}
 		}
 		s.lev = j
-		lim := s.pos[j] + s.plen
+
+		// This suite needs one distinct position per entrypoint using
+		// it, so it needs the whole contiguous block of levels
+		// [s.lev, len(s.pos)-1], not just s.lev itself.
+		need := len(s.entries)
+		if need < 1 {
+			need = 1
+		}
+		if len(s.pos)-s.lev < need {
+			return 0,errors.New("not enough distinct positions for all entrypoints sharing ciphersuite "+s.id().String()+"; increase its level in suiteLevel/kemLevel")
+		}
+		s.top = s.lev + need - 1
+
+		lim := s.pos[s.top] + s.plen + s.elen
 		if lim > hdrlen {
 			hdrlen = lim
 		}
-		fmt.Printf("levels %d-%d\n", j, len(s.pos)-1)
 	}
-	fmt.Printf("hdrlen %d\n", hdrlen)
-
-	fmt.Println("intermediate point layout:")
-	w.layout.dump();
 
-	// Now we can go back and unreserve all but the point position
-	// for the picked level for each ciphersuite.
+	// Now we can go back and unreserve every level above the block of
+	// positions [s.lev, s.top] actually used by each ciphersuite's
+	// entrypoints.
 	for i := 0; i < nsuites; i++ {
 		s := &stes.s[i]
 		nlevels := len(s.pos)
-		for j := s.lev+1; j < nlevels; j++ {
+		for j := s.top+1; j < nlevels; j++ {
 			w.remove(s.nodes[j])
 			s.nodes[j] = nil
 		}
 	}
 
-	fmt.Println("ciphersuite point layout:")
-	w.layout.dump();
+	// Remember the layout so that Write (via WriteWith) can use it,
+	// possibly repeatedly.
+	w.lay.stes = stes.s
+	w.lay.suite = make(map[suiteID]*suiteInfo, nsuites)
+	for i := range w.lay.stes {
+		si := &w.lay.stes[i]
+		w.lay.suite[si.id()] = si
+	}
+	w.lay.entry = make(map[*Entry]*suiteInfo, len(entrypoints))
+	for i := range entrypoints {
+		e := &entrypoints[i]
+		id, err := entryID(e)
+		if err != nil {
+			return 0,err
+		}
+		si, ok := w.lay.suite[id]
+		if !ok {
+			return 0,errors.New("entrypoint uses a ciphersuite not in suiteLevel/kemLevel: "+id.String())
+		}
+		w.lay.entry[e] = si
+	}
+	w.lay.hdrlen = hdrlen
 
 	return hdrlen,nil
 }
 
+// kdf derives AES-128-sized key material from seed, binding the result
+// to purpose so that keys used for different roles (entrypoint sealing,
+// payload encryption, nonce derivation) never collide even when derived
+// from the same underlying secret.
+func kdf(purpose string, seed []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(purpose))
+	mac.Write(seed)
+	return mac.Sum(nil)[:entryKeyLen]
+}
+
+// freshPayloadKey draws a new entryKeyLen-byte payload key from rand.
+// Payload segment keys must never be derived from anything an observer
+// could recompute (a fixed string) or anything that stays constant
+// across repeated WriteWith calls against the same Layout (an *Entry's
+// pointer address): either would turn encryptSegment's fixed IV into a
+// reused keystream.
+func freshPayloadKey(rand cipher.Stream) []byte {
+	key := make([]byte, entryKeyLen)
+	rand.XORKeyStream(key, key)
+	return key
+}
+
+// encryptSegment XORs data with an AES-CTR keystream derived from key,
+// writing the result into buf at offset off. The key is assumed unique
+// per segment, so a fixed all-zero IV is safe to reuse.
+func encryptSegment(buf []byte, off int, data, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	var iv [aes.BlockSize]byte
+	stream := cipher.NewCTR(block, iv[:])
+	stream.XORKeyStream(buf[off:off+len(data)], data)
+	return nil
+}
+
+// payseg describes where one entrypoint's payload data lives in the
+// blob Write produces, and the key it was encrypted with.
+type payseg struct {
+	key        []byte
+	start, end int
+}
+
+// seal encrypts and writes one entrypoint's fixed-length slot into
+// buf[at:], binding the recipient to the symmetric payload key and
+// byte range described by s. The AEAD key is derived from the DH
+// shared secret between the entrypoint's public key and the
+// ciphersuite's ephemeral private key dhpri; the nonce is derived from
+// the slot's position in the header, so it never repeats for a given
+// key without needing to be transmitted.
+func seal(buf []byte, at int, ste crypto.Suite, dhpri crypto.Secret,
+		pub crypto.Point, s payseg) error {
+
+	shared := ste.Point().Mul(pub, dhpri)
+	key := kdf("NegoEntryKey:"+ste.String(), shared.Encode())
+
+	var posb [4]byte
+	binary.BigEndian.PutUint32(posb[:], uint32(at))
+	nonce := kdf("NegoEntryNonce:"+ste.String(), posb[:])
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	plain := make([]byte, entryPlainLen)
+	copy(plain[0:entryKeyLen], s.key)
+	binary.BigEndian.PutUint32(plain[entryKeyLen:entryKeyLen+entryOffLen], uint32(s.start))
+	binary.BigEndian.PutUint32(plain[entryKeyLen+entryOffLen:], uint32(s.end))
+
+	ct := gcm.Seal(nil, nonce[:gcm.NonceSize()], plain, nil)
+	copy(buf[at:], ct)
+	return nil
+}
+
+// Write produces a complete negotiation header together with its
+// appended payload region, using the layout already computed by
+// Init. It is equivalent to w.Layout().WriteWith(...), and exists for
+// the common case of producing just one header from a Writer; see
+// WriteWith's doc comment for the full behavior, and Layout's for how
+// to amortize layout cost across many headers.
+func (w *Writer) Write(entryData map[*Entry][]byte, payload []byte,
+			rand cipher.Stream) ([]byte, error) {
+	return w.lay.WriteWith(entryData, payload, rand)
+}
+
+// WriteWith produces a complete negotiation header together with its
+// appended payload region, using a Layout computed once by Init (via
+// Writer.Layout) and reused across as many independent headers as the
+// caller likes. Every entrypoint registered with Init gets a sealed
+// slot pointing to a range of the payload: entries with an entry in
+// entryData get a private range of their own, encrypted under a key
+// unique to them; all other entries share the single range formed by
+// payload, encrypted under one shared key. Every payload key is drawn
+// fresh from rand on every call, so reusing a Layout across many
+// headers never reuses a key, even though the Layout's position
+// schedule itself is fixed. Every byte of the header not used by a
+// ciphersuite's chosen position is filled with bytes from rand, so the
+// blob as a whole is indistinguishable from random.
+func (l *Layout) WriteWith(entryData map[*Entry][]byte, payload []byte,
+			rand cipher.Stream) ([]byte, error) {
+
+	// Lay out the payload region following the header. Every key is
+	// fresh randomness drawn from rand, not derived from anything
+	// static or observable, so WriteWith never reuses a key across
+	// repeated calls against the same Layout.
+	sharedSeg := payseg{freshPayloadKey(rand), l.hdrlen, l.hdrlen + len(payload)}
+	off := sharedSeg.end
+
+	segs := make(map[*Entry]payseg, len(l.entry))
+	for e := range l.entry {
+		data, custom := entryData[e]
+		if !custom {
+			segs[e] = sharedSeg
+			continue
+		}
+		start := off
+		off += len(data)
+		segs[e] = payseg{freshPayloadKey(rand), start, off}
+	}
+
+	buf := make([]byte, off)
+	rand.XORKeyStream(buf[:l.hdrlen], buf[:l.hdrlen])
+
+	if err := encryptSegment(buf, sharedSeg.start, payload, sharedSeg.key); err != nil {
+		return nil, err
+	}
+	for e, data := range entryData {
+		s := segs[e]
+		if err := encryptSegment(buf, s.start, data, s.key); err != nil {
+			return nil, err
+		}
+	}
 
-// 
-//func (w *Writer) Write(entryData map[Entry][]byte, suffix []byte)
+	// Generate a fresh ephemeral DH key for every classical ciphersuite
+	// used in this header, and seal every entrypoint using it -- each
+	// at its own position, si.lev+k for the k'th entry in si.entries,
+	// so that entrypoints sharing a ciphersuite never collide. For a
+	// KEM ciphersuite, each entrypoint has its own ciphertext anyway,
+	// so it's likewise sealed at its own position.
+	for i := range l.stes {
+		si := &l.stes[i]
+
+		if si.ste != nil {
+			// Classical path: one ephemeral DH key per suite,
+			// shared by every recipient using that suite, but
+			// each recipient's entrypoint is hidden and sealed
+			// at its own position.
+			ste := si.ste
+			dhpri := ste.Secret().Pick(rand)
+			dhpub := ste.Point().Mul(nil, dhpri)
+
+			for k, e := range si.entries {
+				pos := si.pos[si.lev+k]
+				dhrep := dhpub.(crypto.Hiding).HideEncode(rand)
+				copy(buf[pos:pos+si.plen], dhrep)
+				if err := seal(buf, pos+si.plen, ste, dhpri, e.PubKey, segs[e]); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// KEM path: each entrypoint's ciphertext is tied to its own
+		// recipient's public key.
+		kem := si.kem
+		for k, e := range si.entries {
+			pos := si.pos[si.lev+k]
+			ct, ss, err := kem.Encapsulate(e.KEMPub, rand)
+			if err != nil {
+				return nil, err
+			}
+			copy(buf[pos:pos+si.plen], ct)
+			if err := sealKEM(buf, pos+si.plen, kem, ss, segs[e]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if l.padding != nil {
+		padded := l.padding(len(buf))
+		if padded > len(buf) {
+			ext := make([]byte, padded)
+			copy(ext, buf)
+			rand.XORKeyStream(ext[len(buf):], ext[len(buf):])
+			buf = ext
+		}
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,63 @@
+package nego
+
+import (
+	"fmt"
+	"testing"
+)
+
+// FuzzLayout feeds adversarial suite counts, level counts and entryLen
+// choices through Init, using toyKEM (defined in nego_bench_test.go)
+// so the fuzz target has no dependency on a concrete dissent/crypto
+// ciphersuite. Init must either return a valid, non-overlapping layout
+// or a clean error -- never panic -- and every blob successfully
+// produced from such a layout must round-trip through Reader.ReadKEM.
+// nlevels is allowed down to 0, an invalid level every ciphersuite
+// struct is expected to reject cleanly rather than panic on.
+func FuzzLayout(f *testing.F) {
+	f.Add([]byte{4, 40, 1})
+	f.Add([]byte{0, 0, 0})
+	f.Add([]byte{8, 200, 4, 1, 2, 3, 4})
+	f.Add([]byte{1, 255, 8})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 3 {
+			return
+		}
+		nlevels := int(data[0] % 7)               // 0..6, including the invalid 0
+		entryLen := minEntryLen + int(data[1]%64) // minEntryLen..minEntryLen+63
+		nsuites := int(data[2]%4) + 1              // 1..4
+
+		kemLevel := make(map[KEMSuite]int, nsuites)
+		priv := make(map[KEMSuite][]byte, nsuites)
+		entries := make([]Entry, 0, nsuites)
+		for i := 0; i < nsuites; i++ {
+			kem := &toyKEM{fmt.Sprintf("fuzz-kem-%d", i)}
+			kemLevel[kem] = nlevels
+			pub := []byte{byte(i), byte(i * 7), byte(len(data))}
+			priv[kem] = pub
+			entries = append(entries, Entry{KEM: kem, KEMPub: pub})
+		}
+
+		var w Writer
+		w.LayoutSeed = data
+		if _, err := w.Init(nil, kemLevel, entryLen, entries, benchStream()); err != nil {
+			return // a clean error is an acceptable outcome for adversarial input
+		}
+
+		blob, err := w.Write(nil, []byte("fuzz-payload"), benchStream())
+		if err != nil {
+			t.Fatalf("Write failed after a successful Init: %v", err)
+		}
+
+		var r Reader
+		for kem := range kemLevel {
+			payload, err := r.ReadKEM(blob, kem, priv[kem], entryLen, kemLevel, data)
+			if err != nil {
+				t.Fatalf("ReadKEM could not find its own entrypoint: %v", err)
+			}
+			if string(payload) != "fuzz-payload" {
+				t.Fatalf("round-tripped payload mismatch: got %q", payload)
+			}
+		}
+	})
+}
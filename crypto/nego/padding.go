@@ -0,0 +1,27 @@
+package nego
+
+import "math/bits"
+
+// Padding computes, for the true length of an encoded negotiation
+// blob, the length it should actually be padded out to before
+// transmission. Writer.SetPadding installs one to apply to every blob
+// produced by Write.
+type Padding func(trueLen int) int
+
+// PadmePadding implements the PADME scheme: given a true length L, it
+// rounds up to a length whose number of low-order zero bits grows
+// with log2(L), bounding what an observer can learn about the exact
+// value of L to O(log log L) bits, at an expected size overhead of
+// the same order.
+//
+// Concretely, for E = floor(log2(L)) and S = floor(log2(E))+1, L is
+// rounded up to the next multiple of 2^(E-S).
+func PadmePadding(trueLen int) int {
+	if trueLen <= 1 {
+		return trueLen
+	}
+	e := bits.Len(uint(trueLen)) - 1	// floor(log2(L))
+	s := bits.Len(uint(e))			// floor(log2(E))+1
+	mult := 1 << uint(e-s)
+	return (trueLen + mult - 1) &^ (mult - 1)
+}
@@ -0,0 +1,46 @@
+package nego
+
+import (
+	"math/bits"
+	"testing"
+)
+
+// expectedZeroBits returns the number of low-order zero bits PADME
+// guarantees for a true length L, i.e. E-S as defined by PadmePadding.
+func expectedZeroBits(trueLen int) int {
+	e := bits.Len(uint(trueLen)) - 1
+	s := bits.Len(uint(e))
+	return e - s
+}
+
+func TestPadmePaddingNeverLeaksMoreThanExpected(t *testing.T) {
+	for l := 2; l < 1<<20; l = l + 1 + l/37 {
+		padded := PadmePadding(l)
+		if padded < l {
+			t.Fatalf("PadmePadding(%d) = %d, shorter than input", l, padded)
+		}
+
+		want := expectedZeroBits(l)
+		got := bits.TrailingZeros(uint(padded))
+		if padded != 0 && got < want {
+			t.Fatalf("PadmePadding(%d) = %d has only %d trailing zero bits, want >= %d",
+				l, padded, got, want)
+		}
+
+		// Overhead should stay proportional to the same O(log log L) bound.
+		if overhead := padded - l; overhead > (1 << uint(want+1)) {
+			t.Fatalf("PadmePadding(%d) = %d, overhead %d exceeds bound",
+				l, padded, overhead)
+		}
+	}
+}
+
+func TestPadmePaddingIdempotent(t *testing.T) {
+	for l := 2; l < 1<<16; l = l + 1 + l/19 {
+		padded := PadmePadding(l)
+		if again := PadmePadding(padded); again != padded {
+			t.Fatalf("PadmePadding(%d) = %d is not a fixed point: PadmePadding(%d) = %d",
+				l, padded, padded, again)
+		}
+	}
+}
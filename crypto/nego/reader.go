@@ -0,0 +1,134 @@
+package nego
+
+import (
+	"errors"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"dissent/crypto"
+)
+
+// Reader locates and decrypts the entrypoint belonging to a particular
+// recipient within a negotiation header produced by Writer, and
+// recovers the payload region that entrypoint points to.
+type Reader struct {
+}
+
+// Read searches blob for an entrypoint usable by the holder of priv,
+// a private key in suite, and returns the payload that entrypoint
+// grants access to.
+//
+// suiteLevel must be the same map of ciphersuite to maximum level that
+// was passed to the Writer's Init when blob was produced; entryLen
+// must likewise match the entryLen passed there. Read recomputes the
+// candidate position schedule for suite via suiteInfo.init and tries
+// every level in turn, since it has no way to know in advance which
+// level the Writer ultimately chose.
+//
+// Read always walks every candidate level before returning, rather
+// than stopping at the first one that decodes, so that a passive
+// observer timing the call learns nothing about how many entrypoints
+// (if any) in blob belong to this ciphersuite.
+//
+// layoutSeed must match the Writer.LayoutSeed used to produce blob, if
+// any; pass nil if the Writer used the default, ciphersuite-only
+// schedule.
+func (r *Reader) Read(blob []byte, suite crypto.Suite, priv crypto.Secret,
+			entryLen int, suiteLevel map[crypto.Suite]int,
+			layoutSeed []byte) ([]byte, error) {
+
+	if entryLen < minEntryLen {
+		return nil, errors.New("entryLen too small to hold a sealed entrypoint slot")
+	}
+	nlevels, ok := suiteLevel[suite]
+	if !ok {
+		return nil, errors.New("ciphersuite not in suiteLevel: "+suite.String())
+	}
+	hiding, ok := suite.Point().(crypto.Hiding)
+	if !ok {
+		return nil, errors.New("ciphersuite's Point type does not support Hiding")
+	}
+
+	si := suiteInfo{}
+	if err := si.init(suite, nlevels, entryLen, layoutSeed); err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var start, end int
+	found := false
+	for i := 0; i < nlevels; i++ {
+		k, s, e, ok := tryEntry(blob, si.pos[i], si.plen, hiding, suite, priv)
+		if ok && !found {
+			found, key, start, end = true, k, s, e
+		}
+	}
+	if !found {
+		return nil, errors.New("no entrypoint for this recipient in blob")
+	}
+	if start < 0 || end > len(blob) || start > end {
+		return nil, errors.New("entrypoint payload range out of bounds")
+	}
+
+	return decryptSegment(blob[start:end], key)
+}
+
+// tryEntry attempts to decode and open the entrypoint slot at position
+// lo in blob, for the ciphersuite and recipient key given. It reports
+// ok == false, rather than an error, for any failure along the way
+// (bad point encoding, wrong key, truncated blob): at this stage a
+// failure just means "not our entrypoint", which is indistinguishable
+// from "random bytes" to anyone but the caller.
+func tryEntry(blob []byte, lo, plen int, hiding crypto.Hiding,
+		suite crypto.Suite, priv crypto.Secret) (key []byte, start, end int, ok bool) {
+
+	at := lo + plen
+	ctlen := entryPlainLen + entryTagLen
+	if at+ctlen > len(blob) {
+		return nil, 0, 0, false
+	}
+
+	dhpub := hiding.HideDecode(blob[lo : lo+plen])
+	if dhpub == nil {
+		return nil, 0, 0, false
+	}
+	shared := suite.Point().Mul(dhpub, priv)
+	ekey := kdf("NegoEntryKey:"+suite.String(), shared.Encode())
+
+	var posb [4]byte
+	binary.BigEndian.PutUint32(posb[:], uint32(at))
+	nonce := kdf("NegoEntryNonce:"+suite.String(), posb[:])
+
+	block, err := aes.NewCipher(ekey)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	plain, err := gcm.Open(nil, nonce[:gcm.NonceSize()], blob[at:at+ctlen], nil)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+
+	key = make([]byte, entryKeyLen)
+	copy(key, plain[0:entryKeyLen])
+	start = int(binary.BigEndian.Uint32(plain[entryKeyLen : entryKeyLen+entryOffLen]))
+	end = int(binary.BigEndian.Uint32(plain[entryKeyLen+entryOffLen:]))
+	return key, start, end, true
+}
+
+// decryptSegment is the dual of encryptSegment: it recovers plaintext
+// from ciphertext encrypted under the same AES-CTR keystream scheme.
+func decryptSegment(ct, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var iv [aes.BlockSize]byte
+	stream := cipher.NewCTR(block, iv[:])
+	pt := make([]byte, len(ct))
+	stream.XORKeyStream(pt, ct)
+	return pt, nil
+}
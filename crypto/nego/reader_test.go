@@ -0,0 +1,277 @@
+package nego
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"dissent/crypto"
+)
+
+// fakeMod bounds the toy commutative ring fakeSuite's Secret and Point
+// arithmetic works over. It is not a real Diffie-Hellman group -- just
+// enough structure to exercise Reader.Read end to end without
+// depending on a concrete dissent/crypto ciphersuite, mirroring
+// toyKEM's role for the KEM path. fakeSecret and fakePoint implement
+// the full abstract Secret/Point method sets (Add/Sub/Neg/Equal and
+// friends), not just the handful nego.go itself calls (Pick, Mul,
+// Encode/Decode, Hiding), so that assigning *fakeSuite into a
+// map[crypto.Suite]int actually satisfies the interface rather than
+// merely duck-typing the methods this package happens to use.
+const fakeMod = 1000000007
+
+// fakeSecret is a minimal, insecure crypto.Secret test double.
+type fakeSecret struct{ v uint64 }
+
+func (s *fakeSecret) Equal(s2 crypto.Secret) bool       { return s.v == s2.(*fakeSecret).v }
+func (s *fakeSecret) Set(a crypto.Secret) crypto.Secret { s.v = a.(*fakeSecret).v; return s }
+func (s *fakeSecret) Clone() crypto.Secret              { return &fakeSecret{s.v} }
+func (s *fakeSecret) Zero() crypto.Secret               { return &fakeSecret{0} }
+func (s *fakeSecret) One() crypto.Secret                { return &fakeSecret{1} }
+
+func (s *fakeSecret) SetInt64(v int64) crypto.Secret {
+	s.v = uint64(v) % fakeMod
+	return s
+}
+
+func (s *fakeSecret) Add(a, b crypto.Secret) crypto.Secret {
+	return &fakeSecret{(a.(*fakeSecret).v + b.(*fakeSecret).v) % fakeMod}
+}
+
+func (s *fakeSecret) Sub(a, b crypto.Secret) crypto.Secret {
+	return &fakeSecret{(a.(*fakeSecret).v + fakeMod - b.(*fakeSecret).v) % fakeMod}
+}
+
+func (s *fakeSecret) Neg(a crypto.Secret) crypto.Secret {
+	return &fakeSecret{(fakeMod - a.(*fakeSecret).v) % fakeMod}
+}
+
+func (s *fakeSecret) Mul(a, b crypto.Secret) crypto.Secret {
+	return &fakeSecret{(a.(*fakeSecret).v * b.(*fakeSecret).v) % fakeMod}
+}
+
+// Inv is never exercised by these tests (nego.go has no need for a
+// modular inverse), so this toy type doesn't bother computing a real
+// one; Div is expressed in terms of it purely to round out the
+// interface.
+func (s *fakeSecret) Inv(a crypto.Secret) crypto.Secret { return a }
+func (s *fakeSecret) Div(a, b crypto.Secret) crypto.Secret {
+	return s.Mul(a, s.Inv(b))
+}
+
+func (s *fakeSecret) Pick(rand cipher.Stream) crypto.Secret {
+	var buf [8]byte
+	rand.XORKeyStream(buf[:], buf[:])
+	v := binary.BigEndian.Uint64(buf[:]) % fakeMod
+	if v == 0 {
+		v = 1
+	}
+	return &fakeSecret{v}
+}
+
+func (s *fakeSecret) SetBytes(buf []byte) crypto.Secret {
+	var b [8]byte
+	copy(b[8-len(buf):], buf)
+	s.v = binary.BigEndian.Uint64(b[:]) % fakeMod
+	return s
+}
+
+func (s *fakeSecret) Len() int { return 8 }
+
+func (s *fakeSecret) Encode() []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], s.v)
+	return b[:]
+}
+
+func (s *fakeSecret) Decode(buf []byte) error {
+	if len(buf) < 8 {
+		return errors.New("fakeSecret: short buffer")
+	}
+	s.v = binary.BigEndian.Uint64(buf[:8]) % fakeMod
+	return nil
+}
+
+func (s *fakeSecret) String() string { return "fakeSecret" }
+
+// fakePoint is a minimal, insecure crypto.Point test double. Mul treats
+// a nil base as the group generator, so suite.Point().Mul(nil, priv)
+// and a later suite.Point().Mul(pub, priv) agree by commutativity, the
+// same way real DH key agreement does.
+type fakePoint struct{ v uint64 }
+
+const fakeGenerator = 5
+
+func (p *fakePoint) Equal(p2 crypto.Point) bool { return p.v == p2.(*fakePoint).v }
+func (p *fakePoint) Null() crypto.Point         { return &fakePoint{0} }
+func (p *fakePoint) Base() crypto.Point         { return &fakePoint{fakeGenerator} }
+
+func (p *fakePoint) Pick(rand cipher.Stream) crypto.Point {
+	var buf [8]byte
+	rand.XORKeyStream(buf[:], buf[:])
+	return &fakePoint{binary.BigEndian.Uint64(buf[:]) % fakeMod}
+}
+
+func (p *fakePoint) Add(a, b crypto.Point) crypto.Point {
+	return &fakePoint{(a.(*fakePoint).v + b.(*fakePoint).v) % fakeMod}
+}
+
+func (p *fakePoint) Sub(a, b crypto.Point) crypto.Point {
+	return &fakePoint{(a.(*fakePoint).v + fakeMod - b.(*fakePoint).v) % fakeMod}
+}
+
+func (p *fakePoint) Neg(a crypto.Point) crypto.Point {
+	return &fakePoint{(fakeMod - a.(*fakePoint).v) % fakeMod}
+}
+
+func (p *fakePoint) Mul(base crypto.Point, s crypto.Secret) crypto.Point {
+	bv := uint64(fakeGenerator)
+	if base != nil {
+		bv = base.(*fakePoint).v
+	}
+	return &fakePoint{(bv * s.(*fakeSecret).v) % fakeMod}
+}
+
+func (p *fakePoint) Len() int { return 8 }
+
+func (p *fakePoint) Encode() []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], p.v)
+	return b[:]
+}
+
+func (p *fakePoint) Decode(buf []byte) error {
+	if len(buf) < 8 {
+		return errors.New("fakePoint: short buffer")
+	}
+	p.v = binary.BigEndian.Uint64(buf[:8]) % fakeMod
+	return nil
+}
+
+func (p *fakePoint) String() string { return "fakePoint" }
+
+func (p *fakePoint) HideLen() int { return 8 }
+
+func (p *fakePoint) HideEncode(rand cipher.Stream) []byte {
+	return p.Encode()
+}
+
+func (p *fakePoint) HideDecode(rep []byte) crypto.Point {
+	if len(rep) < 8 {
+		return nil
+	}
+	return &fakePoint{binary.BigEndian.Uint64(rep[:8]) % fakeMod}
+}
+
+// fakeSuite is a minimal, insecure crypto.Suite test double exercising
+// the classical DH path in these round-trip tests, the Reader.Read
+// counterpart to toyKEM's role for ReadKEM.
+type fakeSuite struct{ name string }
+
+func (s *fakeSuite) String() string        { return s.name }
+func (s *fakeSuite) Point() crypto.Point   { return &fakePoint{} }
+func (s *fakeSuite) Secret() crypto.Secret { return &fakeSecret{} }
+
+func newFakeEntry(suite *fakeSuite, rand cipher.Stream) (Entry, crypto.Secret) {
+	priv := (&fakeSecret{}).Pick(rand)
+	pub := suite.Point().Mul(nil, priv)
+	return Entry{Suite: suite, PubKey: pub}, priv
+}
+
+// TestReadRoundTrip exercises the classical DH path end to end: Init,
+// Write and Reader.Read all agree on the shared payload for an
+// entrypoint with no private entryData, with SetPadding enabled so the
+// padded blob length is also covered.
+func TestReadRoundTrip(t *testing.T) {
+	suite := &fakeSuite{"fake-dh"}
+	entry, priv := newFakeEntry(suite, benchStream())
+	suiteLevel := map[crypto.Suite]int{suite: 4}
+
+	var w Writer
+	w.SetPadding(PadmePadding)
+	if _, err := w.Init(suiteLevel, nil, minEntryLen, []Entry{entry}, benchStream()); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	payload := []byte("classical-dh-payload")
+	blob, err := w.Write(nil, payload, benchStream())
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var r Reader
+	got, err := r.Read(blob, suite, priv, minEntryLen, suiteLevel, nil)
+	if err != nil {
+		t.Fatalf("Read could not find its own entrypoint: %v", err)
+	}
+	if string(got) != string(payload) {
+		t.Fatalf("round-tripped payload mismatch: got %q, want %q", got, payload)
+	}
+}
+
+// TestReadRoundTripPrivateEntryData exercises the per-entry private
+// payload path: an entrypoint with its own entryData must recover that
+// private data, not the shared payload.
+func TestReadRoundTripPrivateEntryData(t *testing.T) {
+	suite := &fakeSuite{"fake-dh-private"}
+	entry, priv := newFakeEntry(suite, benchStream())
+	suiteLevel := map[crypto.Suite]int{suite: 4}
+
+	var w Writer
+	if _, err := w.Init(suiteLevel, nil, minEntryLen, []Entry{entry}, benchStream()); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	private := []byte("private-to-this-recipient")
+	entryData := map[*Entry][]byte{&entry: private}
+	blob, err := w.Write(entryData, []byte("shared-payload-unused"), benchStream())
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	var r Reader
+	got, err := r.Read(blob, suite, priv, minEntryLen, suiteLevel, nil)
+	if err != nil {
+		t.Fatalf("Read could not find its own entrypoint: %v", err)
+	}
+	if string(got) != string(private) {
+		t.Fatalf("private entryData mismatch: got %q, want %q", got, private)
+	}
+}
+
+// TestReadRoundTripSharedSuite exercises multiple entrypoints drawn
+// from the same ciphersuite, the normal case Writer's own doc comment
+// advertises ("Different public keys may be drawn from different
+// ciphersuites, in any combination"). Every entrypoint must get its
+// own sealed slot: one recipient successfully reading theirs must
+// never cost another recipient of the same suite their entrypoint.
+func TestReadRoundTripSharedSuite(t *testing.T) {
+	suite := &fakeSuite{"fake-dh-shared"}
+	entryA, privA := newFakeEntry(suite, benchStream())
+	entryB, privB := newFakeEntry(suite, benchStream())
+	entryC, privC := newFakeEntry(suite, benchStream())
+	suiteLevel := map[crypto.Suite]int{suite: 4}
+
+	var w Writer
+	entries := []Entry{entryA, entryB, entryC}
+	if _, err := w.Init(suiteLevel, nil, minEntryLen, entries, benchStream()); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	payload := []byte("shared-suite-payload")
+	blob, err := w.Write(nil, payload, benchStream())
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	var r Reader
+	for _, priv := range []crypto.Secret{privA, privB, privC} {
+		got, err := r.Read(blob, suite, priv, minEntryLen, suiteLevel, nil)
+		if err != nil {
+			t.Fatalf("Read could not find an entrypoint sharing the ciphersuite: %v", err)
+		}
+		if string(got) != string(payload) {
+			t.Fatalf("round-tripped payload mismatch: got %q, want %q", got, payload)
+		}
+	}
+}